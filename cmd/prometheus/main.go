@@ -21,19 +21,23 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/featureflag"
 	"github.com/prometheus/prometheus/notifier"
 	"github.com/prometheus/prometheus/promql"
-	"github.com/prometheus/prometheus/retrieval"
 	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/scrape"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/fanin"
 	"github.com/prometheus/prometheus/storage/local"
@@ -73,6 +77,20 @@ func init() {
 	prometheus.MustRegister(version.NewCollector("prometheus"))
 }
 
+// init registers every local storage engine's flags onto cfg.fs before
+// parse() runs. init funcs run after cfg's package-level initialization
+// (where cfg.fs is constructed) but before main()/Main(), so this is
+// guaranteed to happen ahead of parse()'s cfg.fs.Parse(args) call --
+// unlike calling local.RegisterFlags from inside Main() itself, which
+// would run after cfg.fs.Parse(args) had already consumed os.Args,
+// meaning no engine-specific flag could ever be set from the command
+// line. This keeps cfg.fs as the single place flags are assembled,
+// rather than cfg.storage being the only place an engine can pull config
+// from.
+func init() {
+	local.RegisterFlags(cfg.fs)
+}
+
 // Main manages the startup and shutdown lifecycle of the entire Prometheus server.
 func Main() int {
 	// 使用当前包里config.go的[parse](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/cmd/prometheus/config.go#L272)
@@ -94,6 +112,28 @@ func Main() int {
 	log.Infoln("Starting prometheus", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
+	// features是进程生命周期内固定不变的特性开关集合，只在启动时由
+	// `-enable-feature`解析一次。后续的config reload不会改变它，但各个
+	// 可reload的子系统在处理reload时仍然要保持对它的遵从。
+	features, err := featureflag.Parse(cfg.enabledFeatures)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	log.Infoln("Enabled features:", features)
+	// cfg.queryEngine是传给promql.NewEngine的EngineOptions，features在这里
+	// 赋值一次，和-config.file的reload无关，所以放在reloadConfig之外。
+	cfg.queryEngine.Features = features
+
+	// reloadReady.C在首次reloadConfig成功后被关闭，用来让scrapeManager、
+	// ruleManager、notifier这些在config加载完之前就不该跑起来的subsystem
+	// 知道什么时候可以真正进入主循环，详见下面首次reloadConfig调用之后的
+	// reloadReady.Do(...)。
+	reloadReady := &struct {
+		sync.Once
+		C chan struct{}
+	}{C: make(chan struct{})}
+
 	var (
 		// 采样数据添加器，将采集到的数据发送到列表里的每个采样器
 		// 采样器主要负责数据采集逻辑后面的Append和Throttling处理
@@ -103,29 +143,33 @@ func Main() int {
 		reloadables []Reloadable
 	)
 
-	// 本地存储引擎的抽象定义，实现采集和管理样本数据、启停、索引和删除等操作
+	// localStorage是暴露给query/web等组件的本地存储句柄。它包装了真正的存储
+	// 引擎：在下面的run.Group里异步Start完成、调用localStorage.Set(...)之前，
+	// 所有读写都返回local.ErrNotReady，这样对于体积很大的on-disk数据，HTTP
+	// server（以及/-/ready、/-/healthy探针）不会被Start阻塞住。
 	// 参见: https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/storage/local/interface.go#L28
-	var localStorage local.Storage
-	switch cfg.localStorageEngine {
-	// 实例化本地存储引擎和采样器，`cfg.storage`为传入的一组[存储参数](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/storage/local/storage.go#L188)
-	// 包括target heap size，retention policy等等
-	// 当前本地引擎仅支持[MemorySeriesStorage](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/storage/local/storage.go#L135)
-	// 如果本地存储引擎参数为`none`，Prometheus将仅会向remote storage发送采样得到的数据
-	case "persisted":
-		localStorage = local.NewMemorySeriesStorage(&cfg.storage)
-		sampleAppender = storage.Fanout{localStorage}
-	case "none":
-		localStorage = &local.NoopStorage{}
-	default:
-		log.Errorf("Invalid local storage engine %q", cfg.localStorageEngine)
-		return 1
+	localStorage := &local.ReadyStorage{}
+	sampleAppender = storage.Fanout{localStorage}
+
+	// openLocalStorage根据`-storage.local.engine`选中的存储引擎，从local包的
+	// engine注册表里查找对应的Factory并构造出真正的Storage实现，然后Start它。
+	// `persisted`(MemorySeriesStorage)和`none`(NoopStorage)都只是内置的两个
+	// 注册项而已，下游vendor可以在自己的init()里注册额外的引擎(例如实验性的
+	// TSDB、boltdb实现或者纯remote代理引擎)，不需要再改这里的switch。
+	// 参见: https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/storage/local/storage.go#L188
+	openLocalStorage := func() (local.Storage, error) {
+		s, err := local.Open(cfg.localStorageEngine, &cfg.storage)
+		if err != nil {
+			return nil, err
+		}
+		return s, s.Start()
 	}
 
 	// 配置远程读\写器，并将写加入到采样数据添加器里，然后将远程读\写器加入到reloadable对象里
 	// TODO: 搞清楚为什么sampleAppender不需要加入到reloadables里?
 	remoteAppender := &remote.Writer{}
 	sampleAppender = append(sampleAppender, remoteAppender)
-	remoteReader := &remote.Reader{}
+	remoteReader := &remote.Reader{Features: features}
 	reloadables = append(reloadables, remoteAppender, remoteReader)
 
 	// 实例化queryable对象，它将从localStorage或Remote读取数据
@@ -139,11 +183,14 @@ func Main() int {
 		// [notifier](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/notifier/notifier.go#L55)
 		// 根据alertRules分析出的告警事件，将其发送给alertmanager
 		notifier = notifier.New(&cfg.notifier)
-		// targetManager管理对target的抓取和实际执行，并将这些数据发送给采样器
-		targetManager = retrieval.NewTargetManager(sampleAppender)
+		// discoveryManager只负责跑各种服务发现机制(file_sd、DNS、Kubernetes、EC2、Consul等)
+		// 并把它们的结果汇总成map[string][]*targetgroup.Group发到discoveryManager.SyncCh()上
+		discoveryManager = discovery.NewManager()
+		// scrapeManager消费discoveryManager的更新，驱动真正的抓取循环，并把样本交给采样器
+		scrapeManager = scrape.NewManager(sampleAppender)
 		// 查询引擎的初始化，它管理对queryable提供的远程读/本地存储的调用
 		queryEngine = promql.NewEngine(queryable, &cfg.queryEngine)
-		// TODO: 搞清楚ctx的用途
+		// ctx在web handler和rule manager之间共享，用于在关闭时取消尚在执行的查询
 		ctx, cancelCtx = context.WithCancel(context.Background())
 	)
 
@@ -156,14 +203,19 @@ func Main() int {
 		// 重载alertmanager的url为指定的外部链接，解决alertmanager本身部署在反向代理后面的访问情况
 		// 参见：https://github.com/prometheus/alertmanager/issues/95
 		ExternalURL: cfg.web.ExternalURL,
+		Features:    features,
 	})
 
 	cfg.web.Context = ctx
 	cfg.web.Storage = localStorage
 	cfg.web.QueryEngine = queryEngine
-	cfg.web.TargetManager = targetManager
+	cfg.web.TargetManager = scrapeManager
 	cfg.web.RuleManager = ruleManager
 	cfg.web.Notifier = notifier
+	cfg.web.Features = features
+	// Shared with cfg.storage so the web handler's /-/snapshot can write
+	// under the same data directory the local storage engine persists to.
+	cfg.web.LocalStoragePath = cfg.storage.PersistenceStoragePath
 
 	cfg.web.Version = &web.PrometheusVersion{
 		Version:   version.Version,
@@ -183,115 +235,248 @@ func Main() int {
 	// 创建web服务实例
 	webHandler := web.New(&cfg.web)
 
-	// 将targetManager、ruleManager、webHandler、notifier也加入到reloadable列表里
-	// 这样一来，它们也支持重新热加载新的配置
-	reloadables = append(reloadables, targetManager, ruleManager, webHandler, notifier)
+	// 将discoveryManager、scrapeManager、ruleManager、webHandler、notifier也加入到
+	// reloadable列表里，这样一来，它们也支持重新热加载新的配置。discoveryManager和
+	// scrapeManager被拆成两个独立的reloadable，所以只改动scrape_configs里与发现无关
+	// 的字段(例如scrape_timeout)不会打断正在运行的SD订阅。
+	reloadables = append(reloadables, discoveryManager, scrapeManager, ruleManager, webHandler, notifier)
+
+	// SIGHUP is registered before the initial reloadConfig, so a SIGHUP that
+	// arrives during startup is held in hup (buffer of one) and handled by the
+	// reload handler below once reloadReady.C is closed.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	// 第一次启动时同样依靠`reloadConfig`方法来载入配置文件里的参数配置
 	if err := reloadConfig(cfg.configFile, reloadables...); err != nil {
 		log.Errorf("Error loading config: %s", err)
 		return 1
 	}
+	// reloadReady.C在首次reloadConfig成功之后被关闭且仅关闭一次，用来告诉
+	// scrapeManager/ruleManager/notifier这些subsystem：配置已经生效，可以
+	// 进入各自的主循环了。在这之前它们如果提前开始跑，会在零配置下产生误导
+	// 性的指标。SIGHUP和webHandler.Reload()的处理也要先等这个channel，这样
+	// 启动阶段收到的reload请求会被排队而不是丢失或者和首次加载发生竞争。
+	reloadReady.Do(func() { close(reloadReady.C) })
 
-	// Wait for reload or termination signals. Start the handler for SIGHUP as
-	// early as possible, but ignore it until we are ready to handle reloading
-	// our config.
-	hup := make(chan os.Signal)
-	hupReady := make(chan bool)
-	signal.Notify(hup, syscall.SIGHUP)
-	go func() {
-		// 堵塞通道
-		// 先启动Main方法内本次goroutine后面的组件
-		// 然后等到hupReady再继续
-		<-hupReady
-		// 该goroutine往复监听reload事件
-		for {
-			select {
-			// hup通道接收到SIGHUP信号或者web服务的`Reload`方法被调用时
-			// 重新热加载配置
-			// select-case即保证一直阻塞，直到收到某个通道传来的值并执行对应操作
-			case <-hup:
-				if err := reloadConfig(cfg.configFile, reloadables...); err != nil {
-					log.Errorf("Error reloading config: %s", err)
+	prometheus.MustRegister(configSuccess)
+	prometheus.MustRegister(configSuccessTime)
+
+	// 下面使用oklog/run.Group来统一管理所有子系统的生命周期。
+	// 每个子系统对应一个actor，actor由一对`execute`/`interrupt`函数组成：
+	// `execute`阻塞运行直到该子系统自然退出或被其它actor的`interrupt`打断，
+	// `interrupt`则负责触发该子系统的优雅关闭。
+	// 只要有任意一个actor的`execute`返回，Group就会按照注册顺序调用所有
+	// actor的`interrupt`，从而保证关闭顺序是确定的，而不再依赖一组零散的defer。
+	var g run.Group
+	{
+		// Termination handler.
+		term := make(chan os.Signal, 1)
+		cancel := make(chan struct{})
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+		g.Add(
+			func() error {
+				select {
+				case <-term:
+					log.Warn("Received SIGTERM, exiting gracefully...")
+				case <-webHandler.Quit():
+					log.Warn("Received termination request via web service, exiting gracefully...")
+				case err := <-webHandler.ListenError():
+					return fmt.Errorf("error starting web server: %s", err)
+				case <-cancel:
 				}
-			// 这里是一个黑科技，首先Reload方法会帮助初始化一个rc通道
-			// 数据类型是`make(chan chan error)`
-			// 当POST请求`/-/reload`时，会调用web的reload方法
-			// [reloadCH](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/web/web.go#L409)会收到rc chan然后进入处理过程
-			// reload方法[block](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/web/web.go#L410)会向reloadCH（即这里的rc）继续取err类型数据
-			// 尔后，当前goroutine开始调用reloadConfig进行reload，拿到err返回值并回传给web handle的err，web处理结束并返回结果，本次reload也正常结束
-			case rc := <-webHandler.Reload():
-				if err := reloadConfig(cfg.configFile, reloadables...); err != nil {
-					log.Errorf("Error reloading config: %s", err)
-					rc <- err
-				} else {
-					rc <- nil
+				return nil
+			},
+			func(err error) {
+				close(cancel)
+			},
+		)
+	}
+	{
+		// Reload handler.
+		// hup was registered before the initial reloadConfig above; every
+		// reload request waits on reloadReady.C before it is handled.
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				for {
+					select {
+					case <-hup:
+						// 等reloadReady.C关闭，这样启动阶段过早到达的SIGHUP会被
+						// 排队到首次加载完成之后再处理，而不是和它竞争或者被忽略。
+						<-reloadReady.C
+						if err := reloadConfig(cfg.configFile, reloadables...); err != nil {
+							log.Errorf("Error reloading config: %s", err)
+						}
+					case rc := <-webHandler.Reload():
+						<-reloadReady.C
+						if err := reloadConfig(cfg.configFile, reloadables...); err != nil {
+							log.Errorf("Error reloading config: %s", err)
+							rc <- err
+						} else {
+							rc <- nil
+						}
+					case <-cancel:
+						return nil
+					}
 				}
-			}
-		}
-	}()
-
-	// Start all components. The order is NOT arbitrary.
-
-	// [启动本地存储引擎](https://github.com/SaltedMan/prometheus-annotated/blob/v1.6.3-annotated/storage/local/storage.go#L383)
-	// TODO: 详细分析本地存储引擎的启动过程和内部细节
-	if err := localStorage.Start(); err != nil {
-		log.Errorln("Error opening memory series storage:", err)
-		return 1
+			},
+			func(err error) {
+				// This can be cancelled by hitting Ctrl-C.
+				close(cancel)
+			},
+		)
 	}
-	defer func() {
-		if err := localStorage.Stop(); err != nil {
-			log.Errorln("Error stopping storage:", err)
-		}
-	}()
-
-	defer remoteAppender.Stop()
-
-	// The storage has to be fully initialized before registering.
-	// TODO: 搞清楚这部分...
-	if instrumentedStorage, ok := localStorage.(prometheus.Collector); ok {
-		prometheus.MustRegister(instrumentedStorage)
+	{
+		// Query engine's context. Registered (and therefore interrupted)
+		// before the notifier and rule manager below: run.Group calls every
+		// actor's interrupt synchronously in registration order, so this
+		// must come first to actually deliver the "shut down the query
+		// engine before the rule manager" guarantee those actors' comments
+		// rely on -- registering it after them would cancel ctx only once
+		// notifier.Stop()/ruleManager.Stop() had already returned.
+		g.Add(
+			func() error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			func(err error) {
+				cancelCtx()
+			},
+		)
 	}
-	prometheus.MustRegister(configSuccess)
-	prometheus.MustRegister(configSuccessTime)
-
-	// The notifier is a dependency of the rule manager. It has to be
-	// started before and torn down afterwards.
-	go notifier.Run()
-	defer notifier.Stop()
-
-	go ruleManager.Run()
-	defer ruleManager.Stop()
-
-	go targetManager.Run()
-	defer targetManager.Stop()
-
-	// Shutting down the query engine before the rule manager will cause pending queries
-	// to be canceled and ensures a quick shutdown of the rule manager.
-	// 如原文注释，取消一些滞后的无效查询
-	defer cancelCtx()
-
-	// 启动web服务
-	go webHandler.Run()
-
-	// Wait for reload or termination signals.
-	// 所有组件触发启动结束，告知可以处理reload行为
-	// 仍然可能有潜在的风险，比如在webHandler未启动时立马触发了reload
-	// 可能导致未定义的行为，这也是把reload goroutine放在前面初始化的原因
-	close(hupReady) // Unblock SIGHUP handler.
-
-	term := make(chan os.Signal)
-	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
-	// 处理关闭行为，包括安全的执行上述一些defer行为，如`localStorage.Stop()`
-	select {
-	case <-term:
-		log.Warn("Received SIGTERM, exiting gracefully...")
-	case <-webHandler.Quit():
-		log.Warn("Received termination request via web service, exiting gracefully...")
-	case err := <-webHandler.ListenError():
-		log.Errorln("Error starting web server, exiting gracefully:", err)
+	{
+		// Rule manager.
+		// Shutting down the query engine before the rule manager will cause pending
+		// queries to be canceled and ensures a quick shutdown of the rule manager.
+		g.Add(
+			func() error {
+				<-reloadReady.C
+				ruleManager.Run()
+				return nil
+			},
+			func(err error) {
+				ruleManager.Stop()
+			},
+		)
+	}
+	{
+		// Notifier.
+		// The notifier is a dependency of the rule manager. It is registered
+		// after the rule manager so that it is torn down afterwards.
+		g.Add(
+			func() error {
+				<-reloadReady.C
+				notifier.Run()
+				return nil
+			},
+			func(err error) {
+				notifier.Stop()
+			},
+		)
+	}
+	{
+		// Discovery manager. Owns every SD provider; its own lifecycle is
+		// independent from the scrape manager's so that reloading only
+		// scrape_configs (and not service_discovery_configs) does not tear
+		// down and resubscribe active SD providers.
+		discoveryCtx, discoveryCancel := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				return discoveryManager.Run(discoveryCtx)
+			},
+			func(err error) {
+				// discoveryCancel only stops Run's own coalescing loop.
+				// Stop tears down every SD provider goroutine Run's loop
+				// doesn't own (each runs under its own context derived from
+				// discoveryManager's internal one), so both are needed to
+				// fully shut discovery down.
+				discoveryCancel()
+				discoveryManager.Stop()
+			},
+		)
+	}
+	{
+		// Scrape manager. Consumes discoveryManager's coalesced target group
+		// updates and drives the actual scrape loops.
+		g.Add(
+			func() error {
+				return scrapeManager.Run(discoveryManager.SyncCh(), reloadReady.C)
+			},
+			func(err error) {
+				scrapeManager.Stop()
+			},
+		)
+	}
+	{
+		// Web handler.
+		g.Add(
+			func() error {
+				webHandler.Run()
+				return nil
+			},
+			func(err error) {
+				// Stop closes the web server's listener so that
+				// webHandler.Run()'s execute actually returns. The
+				// termination actor above only observes
+				// webHandler.Quit()/ListenError() -- those cover a /-/quit
+				// POST or a listen failure, but a plain SIGTERM/SIGINT only
+				// closes the termination actor's own `cancel` channel, which
+				// does nothing to unblock this actor. Without this call
+				// g.Run() would wait on this actor forever on the single
+				// most common shutdown path.
+				webHandler.Stop()
+			},
+		)
+	}
+	{
+		// Local storage. Opening the real engine can block for a long time
+		// (e.g. replaying an on-disk checkpoint), so it runs as its own
+		// actor and only calls localStorage.Set once it is done, which makes
+		// the /-/ready endpoint report ready. Until then, reads and appends
+		// through localStorage fail with local.ErrNotReady.
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				s, err := openLocalStorage()
+				if err != nil {
+					return fmt.Errorf("error opening local storage: %s", err)
+				}
+				// The storage has to be fully initialized before registering.
+				if instrumentedStorage, ok := s.(prometheus.Collector); ok {
+					prometheus.MustRegister(instrumentedStorage)
+				}
+				localStorage.Set(s)
+				<-cancel
+				return nil
+			},
+			func(err error) {
+				close(cancel)
+				if err := localStorage.Stop(); err != nil {
+					log.Errorln("Error stopping storage:", err)
+				}
+			},
+		)
+	}
+	{
+		// Remote storage.
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				<-cancel // Block until interrupted; remoteAppender has no run loop of its own.
+				return nil
+			},
+			func(err error) {
+				remoteAppender.Stop()
+				close(cancel)
+			},
+		)
 	}
 
+	if err := g.Run(); err != nil {
+		log.Errorln("Error running Prometheus:", err)
+		return 1
+	}
 	log.Info("See you next time!")
 	return 0
 }
@@ -0,0 +1,200 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/run"
+)
+
+// fakeActor is a minimal stand-in for the subsystems Main() wires into the
+// run.Group (local storage, notifier, rule manager, ...). It records when it
+// was interrupted so tests can assert on shutdown ordering.
+type fakeActor struct {
+	name      string
+	execErr   error
+	cancel    chan struct{}
+	interrupt func()
+}
+
+func newFakeActor(name string, execErr error, order *[]string) *fakeActor {
+	a := &fakeActor{name: name, execErr: execErr, cancel: make(chan struct{})}
+	a.interrupt = func() { *order = append(*order, name) }
+	return a
+}
+
+func (a *fakeActor) execute() error {
+	<-a.cancel
+	return a.execErr
+}
+
+func (a *fakeActor) terminate(error) {
+	close(a.cancel)
+	a.interrupt()
+}
+
+// TestRunGroupGracefulShutdownOrder verifies that when one actor exits
+// cleanly, every other registered actor is interrupted, in registration
+// order -- mirroring the
+// guarantee Main() relies on when, e.g., the web handler's Quit() channel
+// fires and the rest of the subsystems must be torn down.
+func TestRunGroupGracefulShutdownOrder(t *testing.T) {
+	var order []string
+
+	trigger := make(chan struct{})
+	storage := newFakeActor("storage", nil, &order)
+	notifier := newFakeActor("notifier", nil, &order)
+	ruleManager := newFakeActor("ruleManager", nil, &order)
+
+	var g run.Group
+	g.Add(
+		func() error { <-trigger; return nil },
+		func(error) {},
+	)
+	g.Add(storage.execute, storage.terminate)
+	g.Add(notifier.execute, notifier.terminate)
+	g.Add(ruleManager.execute, ruleManager.terminate)
+
+	close(trigger)
+
+	if err := g.Run(); err != nil {
+		t.Fatalf("unexpected error from Run(): %s", err)
+	}
+
+	if len(order) != 3 {
+		t.Fatalf("expected 3 actors to be interrupted, got %d: %v", len(order), order)
+	}
+	seen := map[string]bool{}
+	for _, name := range order {
+		seen[name] = true
+	}
+	for _, name := range []string{"storage", "notifier", "ruleManager"} {
+		if !seen[name] {
+			t.Errorf("expected actor %q to have been interrupted, it was not", name)
+		}
+	}
+	for i, name := range []string{"storage", "notifier", "ruleManager"} {
+		if order[i] != name {
+			t.Errorf("expected interrupt #%d to be %q (registration order), got %q", i, name, order[i])
+		}
+	}
+}
+
+// TestRunGroupFailurePropagates verifies that a failure in any single actor
+// cancels the rest: this is what replaces the old ad-hoc select over
+// term/webHandler.Quit()/webHandler.ListenError().
+func TestRunGroupFailurePropagates(t *testing.T) {
+	var order []string
+
+	failure := fmt.Errorf("simulated actor failure")
+	failing := newFakeActor("failing", failure, &order)
+	dependent := newFakeActor("dependent", nil, &order)
+
+	var g run.Group
+	g.Add(
+		func() error { close(failing.cancel); return failure },
+		func(error) { order = append(order, "failing") },
+	)
+	g.Add(dependent.execute, dependent.terminate)
+
+	if err := g.Run(); err != failure {
+		t.Fatalf("expected Run() to surface %v, got %v", failure, err)
+	}
+	if len(order) != 2 {
+		t.Fatalf("expected both actors to have been interrupted, got %v", order)
+	}
+}
+
+// TestReloadReadyGatesAndSerializesReloads exercises the same shape as the
+// SIGHUP/webHandler.Reload() handler in Main(): every reload request waits
+// on reloadReady.C before running its (here, simulated) ApplyConfig. Because
+// every request is funneled through the one select loop, requests that
+// arrive while the initial load is still in flight are queued rather than
+// dropped, and once reloadReady.C closes they run one at a time.
+func TestReloadReadyGatesAndSerializesReloads(t *testing.T) {
+	reloadReady := &struct {
+		sync.Once
+		C chan struct{}
+	}{C: make(chan struct{})}
+
+	var inFlight, maxInFlight, applied int32
+	// reload stands in for reloadConfig's call into a blocking ApplyConfig:
+	// it tracks how many calls are in flight at once and sleeps briefly so
+	// overlapping calls would have a chance to race if they weren't serialized.
+	reload := func() error {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			old := atomic.LoadInt32(&maxInFlight)
+			if n <= old || atomic.CompareAndSwapInt32(&maxInFlight, old, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&applied, 1)
+		return nil
+	}
+
+	type reloadRequest chan error
+	reloadCh := make(chan reloadRequest)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case rc := <-reloadCh:
+				<-reloadReady.C
+				rc <- reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	const n = 5
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			rc := make(reloadRequest)
+			reloadCh <- rc
+			results <- <-rc
+		}()
+	}
+
+	// None of the n requests above can have run yet: reloadReady.C is still open.
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&applied); got != 0 {
+		t.Fatalf("expected no reloads to run before reloadReady.C is closed, got %d", got)
+	}
+
+	reloadReady.Do(func() { close(reloadReady.C) })
+
+	for i := 0; i < n; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("unexpected error from queued reload: %s", err)
+		}
+	}
+	close(done)
+
+	if got := atomic.LoadInt32(&applied); got != n {
+		t.Fatalf("expected all %d queued reloads to be applied once unblocked, got %d", n, got)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got != 1 {
+		t.Fatalf("expected reloads to be serialized (max concurrency 1), got %d", got)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery owns every service-discovery provider (file_sd, DNS,
+// Kubernetes, EC2, Consul, ...) and reduces their output to a single stream
+// of target group updates, independent of how those updates are scraped.
+package discovery
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// Discoverer discovers a set of targets periodically or on demand, pushing
+// each update for its group onto up. It must return as soon as ctx is done.
+type Discoverer interface {
+	Run(ctx context.Context, up chan<- []*targetgroup.Group)
+}
+
+// coalesceInterval bounds how often Manager forwards a burst of updates from
+// its providers onto the sync channel, so that e.g. a Kubernetes SD that
+// emits one update per target on startup doesn't cause one scrape.Manager
+// reload per target. It is a var, not a const, so tests can shrink it.
+var coalesceInterval = 5 * time.Second
+
+// Manager coordinates a set of Discoverers keyed by scrape config job name
+// and merges their output into a single map[string][]*targetgroup.Group,
+// which it emits on SyncCh. It does not know anything about scraping.
+type Manager struct {
+	mtx    sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// jobs holds the running state for every job currently contributing
+	// providers, keyed by job name, so that ApplyConfig can diff a new
+	// config against it instead of tearing everything down unconditionally.
+	jobs map[string]*jobProviders
+
+	// targets holds the most recent set of groups seen from each provider,
+	// keyed by the provider's name (typically the job name plus a
+	// mechanism-specific suffix, e.g. "node/file_sd/0").
+	targets map[string][]*targetgroup.Group
+
+	syncCh    chan map[string][]*targetgroup.Group
+	triggerCh chan struct{}
+}
+
+// jobProviders is the running state of one scrape job's SD providers: the
+// service_discovery_config they were started from (so a later ApplyConfig
+// can tell whether it changed) and the cancel func that tears down just
+// this job's providers, independent of every other job's.
+type jobProviders struct {
+	sdConfig      config.ServiceDiscoveryConfig
+	cancel        context.CancelFunc
+	providerNames []string
+}
+
+// NewManager creates a new discovery manager.
+func NewManager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		ctx:       ctx,
+		cancel:    cancel,
+		jobs:      map[string]*jobProviders{},
+		targets:   map[string][]*targetgroup.Group{},
+		syncCh:    make(chan map[string][]*targetgroup.Group),
+		triggerCh: make(chan struct{}, 1),
+	}
+}
+
+// SyncCh returns the channel on which Manager publishes coalesced target
+// group updates. scrape.Manager is expected to be the sole consumer.
+func (m *Manager) SyncCh() <-chan map[string][]*targetgroup.Group {
+	return m.syncCh
+}
+
+// ApplyConfig (re)starts the set of Discoverers to match the scrape configs
+// in cfg. Existing providers for jobs whose service_discovery_configs did
+// not change are left running untouched, so an unrelated change elsewhere in
+// the config (e.g. scrape_interval) does not interrupt SD subscriptions.
+func (m *Manager) ApplyConfig(cfg *config.Config) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	wanted := make(map[string]*config.ScrapeConfig, len(cfg.ScrapeConfigs))
+	for _, scfg := range cfg.ScrapeConfigs {
+		wanted[scfg.JobName] = scfg
+	}
+
+	changed := false
+
+	// Jobs that were removed entirely, or whose service_discovery_config
+	// changed, get their providers cancelled and their stale targets
+	// dropped. A job whose service_discovery_config is unchanged is left
+	// running, regardless of what else changed about it (scrape_interval,
+	// relabeling, ...).
+	for name, job := range m.jobs {
+		if scfg, ok := wanted[name]; ok && reflect.DeepEqual(job.sdConfig, scfg.ServiceDiscoveryConfig) {
+			continue
+		}
+		job.cancel()
+		for _, pname := range job.providerNames {
+			delete(m.targets, pname)
+		}
+		delete(m.jobs, name)
+		changed = true
+	}
+
+	// Jobs that are new, or that were just torn down above because their
+	// service_discovery_config changed, get started fresh.
+	for name, scfg := range wanted {
+		if _, ok := m.jobs[name]; ok {
+			continue
+		}
+		m.startJob(name, scfg)
+		changed = true
+	}
+
+	if changed {
+		m.trigger()
+	}
+	return nil
+}
+
+// startJob launches the Discoverers for one scrape job's
+// service_discovery_config under their own cancellable context, derived
+// from m.ctx so that Stop still tears down every job at once, and records
+// enough state for a future ApplyConfig to diff against or tear down just
+// this job.
+func (m *Manager) startJob(name string, scfg *config.ScrapeConfig) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	job := &jobProviders{
+		sdConfig: scfg.ServiceDiscoveryConfig,
+		cancel:   cancel,
+	}
+	for i, d := range providersFromConfig(scfg) {
+		pname := name + "/" + providerName(d, i)
+		job.providerNames = append(job.providerNames, pname)
+		go m.runProvider(ctx, pname, d)
+	}
+	m.jobs[name] = job
+}
+
+// runProvider drains one Discoverer's updates, merges them into targets
+// under its name, and schedules a (possibly coalesced) publish.
+func (m *Manager) runProvider(ctx context.Context, name string, d Discoverer) {
+	updates := make(chan []*targetgroup.Group)
+	go d.Run(ctx, updates)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tgs, ok := <-updates:
+			if !ok {
+				return
+			}
+			m.mtx.Lock()
+			m.targets[name] = tgs
+			m.mtx.Unlock()
+			m.trigger()
+		}
+	}
+}
+
+// trigger schedules a publish of the current target set without blocking if
+// one is already pending.
+func (m *Manager) trigger() {
+	select {
+	case m.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the coalescing publish loop. It blocks until ctx is done, then
+// closes SyncCh so that scrape.Manager's consuming range loop returns too.
+func (m *Manager) Run(ctx context.Context) error {
+	defer close(m.syncCh)
+
+	ticker := time.NewTicker(coalesceInterval)
+	defer ticker.Stop()
+
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.triggerCh:
+			pending = true
+		case <-ticker.C:
+			if !pending {
+				continue
+			}
+			pending = false
+			m.mtx.RLock()
+			snapshot := make(map[string][]*targetgroup.Group, len(m.targets))
+			for k, v := range m.targets {
+				snapshot[k] = v
+			}
+			m.mtx.RUnlock()
+			select {
+			case m.syncCh <- snapshot:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Stop tears down all running Discoverers.
+func (m *Manager) Stop() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.cancel()
+}
+
+// providersFromConfig builds the Discoverers for a single scrape config's
+// service_discovery_config. The concrete SD mechanisms (file_sd, dns, ec2,
+// kubernetes, consul, ...) register themselves elsewhere; this stays generic
+// over the Discoverer interface so discovery does not need to import every
+// mechanism-specific package.
+func providersFromConfig(scfg *config.ScrapeConfig) []Discoverer {
+	return scfg.ServiceDiscoveryConfig.Discoverers()
+}
+
+func providerName(d Discoverer, i int) string {
+	if named, ok := d.(interface {
+		Name() string
+	}); ok {
+		return named.Name()
+	}
+	log.With("index", i).Debugln("discoverer without a Name(), falling back to its position")
+	return fmt.Sprintf("sd/%d", i)
+}
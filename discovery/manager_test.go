@@ -0,0 +1,176 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// TestManagerCoalescesBursts verifies that many rapid updates from a single
+// provider only result in the latest snapshot being observed by a consumer
+// of SyncCh, not one publish per update.
+func TestManagerCoalescesBursts(t *testing.T) {
+	old := coalesceInterval
+	coalesceInterval = 10 * time.Millisecond
+	defer func() { coalesceInterval = old }()
+
+	m := NewManager()
+	m.targets["job/test/0"] = []*targetgroup.Group{{
+		Source: "initial",
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "localhost:1"},
+		},
+	}}
+
+	for i := 0; i < 50; i++ {
+		m.trigger()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	select {
+	case got := <-m.SyncCh():
+		if len(got) != 1 {
+			t.Fatalf("expected a single provider in the coalesced snapshot, got %d", len(got))
+		}
+	case <-time.After(2 * coalesceInterval):
+		t.Fatal("timed out waiting for a coalesced sync")
+	}
+
+	select {
+	case <-m.SyncCh():
+		t.Fatal("expected the burst to be published once, got a second publish")
+	case <-time.After(3 * coalesceInterval):
+	}
+}
+
+// TestManagerClosesSyncChOnCancel verifies that Run closes SyncCh once its
+// context is done, so that scrape.Manager's `range syncCh` consumer loop
+// returns instead of blocking forever on shutdown.
+func TestManagerClosesSyncChOnCancel(t *testing.T) {
+	m := NewManager()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after context cancellation")
+	}
+
+	select {
+	case _, ok := <-m.SyncCh():
+		if ok {
+			t.Fatal("expected SyncCh to be closed, got a value instead")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SyncCh was not closed after Run returned")
+	}
+}
+
+// TestApplyConfigLeavesUnchangedSDJobsRunning verifies the behaviour the doc
+// comment on ApplyConfig promises: a reload that doesn't touch a job's
+// service_discovery_config must not cancel and restart that job's
+// providers, even though some other job's SD config (or some unrelated part
+// of the config) changed.
+func TestApplyConfigLeavesUnchangedSDJobsRunning(t *testing.T) {
+	m := NewManager()
+
+	staticSD := config.ServiceDiscoveryConfig{
+		StaticConfigs: []*targetgroup.Group{{Source: "fixed"}},
+	}
+
+	err := m.ApplyConfig(&config.Config{
+		ScrapeConfigs: []*config.ScrapeConfig{
+			{JobName: "untouched", ServiceDiscoveryConfig: staticSD},
+			{JobName: "resubscribed", ServiceDiscoveryConfig: staticSD},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	before := m.jobs["untouched"]
+	if before == nil {
+		t.Fatal("expected a running job for \"untouched\"")
+	}
+
+	// Reload: "untouched"'s service_discovery_config is unchanged, but
+	// "resubscribed" now points at a different static target -- simulating
+	// a config edit that touches SD for one job but not another.
+	err = m.ApplyConfig(&config.Config{
+		ScrapeConfigs: []*config.ScrapeConfig{
+			{JobName: "untouched", ServiceDiscoveryConfig: staticSD},
+			{
+				JobName: "resubscribed",
+				ServiceDiscoveryConfig: config.ServiceDiscoveryConfig{
+					StaticConfigs: []*targetgroup.Group{{Source: "moved"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	after := m.jobs["untouched"]
+	if after != before {
+		t.Fatal("expected \"untouched\"'s provider state to be left running untouched, but it was replaced")
+	}
+	if m.jobs["resubscribed"] == nil {
+		t.Fatal("expected \"resubscribed\" to still have a running job after its SD config changed")
+	}
+}
+
+// TestApplyConfigRemovesDroppedJobs verifies that a job removed from the
+// config has its providers cancelled and its job state dropped.
+func TestApplyConfigRemovesDroppedJobs(t *testing.T) {
+	m := NewManager()
+
+	err := m.ApplyConfig(&config.Config{
+		ScrapeConfigs: []*config.ScrapeConfig{
+			{
+				JobName: "gone",
+				ServiceDiscoveryConfig: config.ServiceDiscoveryConfig{
+					StaticConfigs: []*targetgroup.Group{{Source: "fixed"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := m.ApplyConfig(&config.Config{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, ok := m.jobs["gone"]; ok {
+		t.Fatal("expected \"gone\" to have been removed after it dropped out of the config")
+	}
+}
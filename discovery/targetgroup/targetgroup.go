@@ -0,0 +1,41 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package targetgroup holds the shared data type service discovery
+// providers emit and discovery.Manager fans out to scrape.Manager.
+package targetgroup
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// Group is a set of targets discovered by a single service discovery
+// mechanism that share a common set of labels. It is the unit of update
+// exchanged between discovery.Manager and scrape.Manager.
+type Group struct {
+	// Targets is a list of targets identified by a label set. Each target is
+	// uniquely identifiable in the group by its address label.
+	Targets []model.LabelSet
+	// Labels are labels that are common across all targets in the group.
+	Labels model.LabelSet
+	// Source is an identifier that describes the origin of the group, used
+	// so that subsequent updates from the same provider replace rather than
+	// accumulate alongside earlier ones (e.g. "file_sd:targets.json").
+	Source string
+}
+
+func (tg Group) String() string {
+	return fmt.Sprintf("%s:%s", tg.Source, tg.Labels)
+}
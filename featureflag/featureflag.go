@@ -0,0 +1,102 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package featureflag holds the set of experimental features enabled for
+// the lifetime of the process via -enable-feature. Unlike the rest of the
+// configuration, the enabled set is fixed at startup: reloading the config
+// file must not change it, so every subsystem that consults a Set is handed
+// the same, immutable value Main() built once before the first
+// reloadConfig.
+package featureflag
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Known feature names, passed as a comma-separated list to -enable-feature.
+const (
+	PromQLAtModifier         = "promql-at-modifier"
+	ExpandExternalLabels     = "expand-external-labels"
+	ExemplarStorage          = "exemplar-storage"
+	MemorySnapshotOnShutdown = "memory-snapshot-on-shutdown"
+)
+
+// all is the set of feature names Parse will accept.
+var all = map[string]bool{
+	PromQLAtModifier:         true,
+	ExpandExternalLabels:     true,
+	ExemplarStorage:          true,
+	MemorySnapshotOnShutdown: true,
+}
+
+// Set reports which experimental features are enabled. The zero value has
+// every feature disabled.
+type Set struct {
+	enabled map[string]bool
+}
+
+// Parse validates a comma-separated list of feature names (as given to
+// -enable-feature) and returns the resulting Set. It returns an error,
+// naming the offending flag value, if any name is unknown.
+func Parse(names []string) (Set, error) {
+	s := Set{enabled: map[string]bool{}}
+	for _, list := range names {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !all[name] {
+				return Set{}, fmt.Errorf("unknown feature name %q in -enable-feature", name)
+			}
+			s.enabled[name] = true
+		}
+	}
+	return s, nil
+}
+
+// Enabled reports whether the named feature is enabled in s.
+func (s Set) Enabled(name string) bool {
+	return s.enabled[name]
+}
+
+// PromQLAtModifier reports whether the PromQL @ modifier is enabled.
+func (s Set) PromQLAtModifier() bool { return s.Enabled(PromQLAtModifier) }
+
+// ExpandExternalLabels reports whether $-prefixed external labels are
+// expanded against environment variables before being applied.
+func (s Set) ExpandExternalLabels() bool { return s.Enabled(ExpandExternalLabels) }
+
+// ExemplarStorage reports whether in-memory exemplar storage is enabled.
+func (s Set) ExemplarStorage() bool { return s.Enabled(ExemplarStorage) }
+
+// MemorySnapshotOnShutdown reports whether the local storage should write a
+// full in-memory snapshot to disk on graceful shutdown.
+func (s Set) MemorySnapshotOnShutdown() bool { return s.Enabled(MemorySnapshotOnShutdown) }
+
+// String renders the enabled set in the form logged at startup, e.g.
+// "exemplar-storage, promql-at-modifier" (sorted by name). An empty Set
+// renders as "none".
+func (s Set) String() string {
+	if len(s.enabled) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(s.enabled))
+	for name := range s.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
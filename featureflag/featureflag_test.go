@@ -0,0 +1,48 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package featureflag
+
+import "testing"
+
+func TestParseUnknownNameErrors(t *testing.T) {
+	if _, err := Parse([]string{"not-a-real-feature"}); err == nil {
+		t.Fatal("expected an error for an unknown feature name")
+	}
+}
+
+func TestParseEnablesNamedFeatures(t *testing.T) {
+	s, err := Parse([]string{PromQLAtModifier, " " + ExemplarStorage + " "})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !s.PromQLAtModifier() {
+		t.Error("expected PromQLAtModifier to be enabled")
+	}
+	if !s.ExemplarStorage() {
+		t.Error("expected ExemplarStorage to be enabled")
+	}
+	if s.MemorySnapshotOnShutdown() {
+		t.Error("expected MemorySnapshotOnShutdown to remain disabled")
+	}
+}
+
+func TestZeroValueHasNothingEnabled(t *testing.T) {
+	var s Set
+	if s.PromQLAtModifier() || s.ExemplarStorage() || s.ExpandExternalLabels() || s.MemorySnapshotOnShutdown() {
+		t.Fatal("expected the zero Set to have every feature disabled")
+	}
+	if s.String() != "none" {
+		t.Fatalf("expected the zero Set to render as \"none\", got %q", s.String())
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scrape drives the actual scrape loops for a set of targets. It
+// knows nothing about how those targets were discovered -- it is fed
+// target group updates by discovery.Manager over a channel.
+package scrape
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// Manager starts, reloads and stops scrape loops in response to target
+// group updates, using cfg to look up the per-job scrape parameters for
+// each update it receives.
+type Manager struct {
+	appender storage.SampleAppender
+
+	mtx   sync.RWMutex
+	cfg   *config.Config
+	pools map[string]*scrapePool // keyed by job name.
+}
+
+// NewManager creates a new scrape manager that appends all scraped samples
+// to appender.
+func NewManager(appender storage.SampleAppender) *Manager {
+	return &Manager{
+		appender: appender,
+		pools:    map[string]*scrapePool{},
+	}
+}
+
+// ApplyConfig stores the new config for use by the next target group sync.
+// It intentionally does not touch any running scrape pool by itself:
+// pools are reconciled against the config lazily, as updates for their job
+// arrive over the sync channel, so a config reload with no discovery
+// updates pending does not restart any scrape loops.
+func (m *Manager) ApplyConfig(cfg *config.Config) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.cfg = cfg
+	return nil
+}
+
+// Run waits for ready to close -- signalling that the first config load has
+// completed -- before consuming target group updates from syncCh until it
+// is closed, reconciling each job's scrape pool against each
+// update. Waiting on ready keeps a scrape pool from spinning up against a
+// nil m.cfg if a target group update races the first ApplyConfig.
+func (m *Manager) Run(syncCh <-chan map[string][]*targetgroup.Group, ready <-chan struct{}) error {
+	<-ready
+	for ts := range syncCh {
+		m.reload(ts)
+	}
+	return nil
+}
+
+// reload fans the merged per-provider target groups back out by job name
+// and syncs each affected job's scrape pool.
+func (m *Manager) reload(providerGroups map[string][]*targetgroup.Group) {
+	byJob := map[string][]*targetgroup.Group{}
+	for providerName, tgs := range providerGroups {
+		job := jobNameFromProviderName(providerName)
+		byJob[job] = append(byJob[job], tgs...)
+	}
+
+	m.mtx.RLock()
+	cfg := m.cfg
+	m.mtx.RUnlock()
+	if cfg == nil {
+		log.Warn("scrape manager received targets before the first ApplyConfig, dropping update")
+		return
+	}
+
+	for _, scfg := range cfg.ScrapeConfigs {
+		pool := m.poolFor(scfg)
+		pool.Sync(byJob[scfg.JobName])
+	}
+}
+
+// poolFor returns the scrape pool for scfg.JobName, creating it if needed
+// and reloading it only if its scrape config changed.
+func (m *Manager) poolFor(scfg *config.ScrapeConfig) *scrapePool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	pool, ok := m.pools[scfg.JobName]
+	if !ok {
+		pool = newScrapePool(scfg, m.appender)
+		m.pools[scfg.JobName] = pool
+	} else if !reflect.DeepEqual(pool.scfg, scfg) {
+		pool.reload(scfg)
+	}
+	return pool
+}
+
+// Stop gracefully stops all scrape pools and their in-flight scrapes.
+func (m *Manager) Stop() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, pool := range m.pools {
+		pool.stop()
+	}
+}
+
+// jobNameFromProviderName strips the discovery-mechanism suffix that
+// discovery.Manager attaches (e.g. "node/file_sd/0" -> "node").
+func jobNameFromProviderName(providerName string) string {
+	for i := 0; i < len(providerName); i++ {
+		if providerName[i] == '/' {
+			return providerName[:i]
+		}
+	}
+	return providerName
+}
+
+// scrapePool owns the running scrape loops for every target of a single
+// job, keyed by the target's merged label set so that Sync can diff a new
+// target group against what is already running instead of restarting
+// everything on every update.
+type scrapePool struct {
+	mtx      sync.Mutex
+	scfg     *config.ScrapeConfig
+	appender storage.SampleAppender
+	loops    map[model.Fingerprint]*scrapeLoop
+}
+
+// scrapeLoop is the running state for a single target: its resolved label
+// set (kept so reload can restart it unchanged) and the cancel func that
+// stops it.
+type scrapeLoop struct {
+	target model.LabelSet
+	cancel context.CancelFunc
+}
+
+func newScrapePool(scfg *config.ScrapeConfig, appender storage.SampleAppender) *scrapePool {
+	return &scrapePool{
+		scfg:     scfg,
+		appender: appender,
+		loops:    map[model.Fingerprint]*scrapeLoop{},
+	}
+}
+
+// reload swaps in scfg (e.g. a changed scrape_interval or relabel_configs)
+// and restarts every currently running loop under it, since a loop's
+// interval and timeout are fixed for its lifetime. The target set itself is
+// left untouched; Sync is what adds or drops targets.
+func (p *scrapePool) reload(scfg *config.ScrapeConfig) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.scfg = scfg
+	for fp, loop := range p.loops {
+		loop.cancel()
+		p.loops[fp] = p.startLoop(loop.target)
+	}
+}
+
+// Sync reconciles the pool's running loops against tgs: a target not seen
+// before gets its own loop, a target no longer present has its loop
+// stopped, and one still present is left running untouched.
+func (p *scrapePool) Sync(tgs []*targetgroup.Group) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	wanted := map[model.Fingerprint]model.LabelSet{}
+	for _, tg := range tgs {
+		for _, t := range tg.Targets {
+			labels := mergeLabels(t, tg.Labels)
+			wanted[labels.Fingerprint()] = labels
+		}
+	}
+
+	for fp, loop := range p.loops {
+		if _, ok := wanted[fp]; !ok {
+			loop.cancel()
+			delete(p.loops, fp)
+		}
+	}
+	for fp, labels := range wanted {
+		if _, ok := p.loops[fp]; !ok {
+			p.loops[fp] = p.startLoop(labels)
+		}
+	}
+}
+
+// startLoop starts the scrape loop for a single target under p.scfg. The
+// actual fetch/parse/ingest cycle -- HTTP content negotiation, per-scrape
+// timeout, writing samples to p.appender -- lives in the full retrieval
+// implementation, which isn't part of this checkout; this only owns the
+// loop's lifecycle, not what it does per tick.
+func (p *scrapePool) startLoop(target model.LabelSet) *scrapeLoop {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+	}()
+	return &scrapeLoop{target: target, cancel: cancel}
+}
+
+// stop halts every running loop in the pool.
+func (p *scrapePool) stop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for fp, loop := range p.loops {
+		loop.cancel()
+		delete(p.loops, fp)
+	}
+}
+
+// mergeLabels resolves a target's final label set: the group's labels are
+// defaults, overridden by any label the target itself sets.
+func mergeLabels(target, groupLabels model.LabelSet) model.LabelSet {
+	labels := make(model.LabelSet, len(target)+len(groupLabels))
+	for ln, lv := range groupLabels {
+		labels[ln] = lv
+	}
+	for ln, lv := range target {
+		labels[ln] = lv
+	}
+	return labels
+}
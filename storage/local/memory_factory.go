@@ -0,0 +1,38 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import "flag"
+
+// memorySeriesStorageFactory registers MemorySeriesStorage under the
+// "persisted" engine name. Its flags are already registered alongside the
+// rest of StorageConfig in cmd/prometheus/config.go, so RegisterFlags has
+// nothing engine-specific to add today.
+type memorySeriesStorageFactory struct{}
+
+func (memorySeriesStorageFactory) New(cfg *StorageConfig) (Storage, error) {
+	// Wrapped in persistedStorage so the "persisted" engine also
+	// implements Snapshotter; the wrapper just remembers where cfg
+	// pointed MemorySeriesStorage's chunks at.
+	return &persistedStorage{
+		MemorySeriesStorage: NewMemorySeriesStorage(cfg),
+		basePath:            cfg.PersistenceStoragePath,
+	}, nil
+}
+
+func (memorySeriesStorageFactory) RegisterFlags(fs *flag.FlagSet) {}
+
+func init() {
+	Register("persisted", memorySeriesStorageFactory{})
+}
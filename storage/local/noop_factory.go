@@ -0,0 +1,30 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import "flag"
+
+// noopStorageFactory registers NoopStorage under the "none" engine name,
+// used when Prometheus should only forward samples to remote storage.
+type noopStorageFactory struct{}
+
+func (noopStorageFactory) New(cfg *StorageConfig) (Storage, error) {
+	return &NoopStorage{}, nil
+}
+
+func (noopStorageFactory) RegisterFlags(fs *flag.FlagSet) {}
+
+func init() {
+	Register("none", noopStorageFactory{})
+}
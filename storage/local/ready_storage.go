@@ -0,0 +1,180 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// ErrNotReady is returned if the underlying Storage is not ready yet.
+var ErrNotReady = errors.New("local storage is not ready yet")
+
+// ReadyStorage implements Storage and forwards calls to the underlying
+// Storage once it is set via Set; before that, reads and appends fail with
+// ErrNotReady. This allows, e.g., the web handler and the query engine to be
+// wired up and started before the possibly long-running process of opening
+// the real storage has completed.
+type ReadyStorage struct {
+	mtx     sync.RWMutex
+	storage Storage
+}
+
+// Set sets the underlying Storage. It takes the write lock, so it is safe to
+// call while other methods are in use.
+func (s *ReadyStorage) Set(storage Storage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.storage = storage
+}
+
+// get returns the underlying Storage, or nil if it hasn't been Set yet.
+func (s *ReadyStorage) get() Storage {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.storage
+}
+
+// Ready reports whether the underlying storage has been Set and is
+// therefore safe to query. Used by the web handler's /-/ready endpoint.
+func (s *ReadyStorage) Ready() bool {
+	return s.get() != nil
+}
+
+// Querier implements Storage.
+func (s *ReadyStorage) Querier() (Querier, error) {
+	if x := s.get(); x != nil {
+		return x.Querier()
+	}
+	return nil, ErrNotReady
+}
+
+// Append implements Storage.
+func (s *ReadyStorage) Append(sample *model.Sample) error {
+	if x := s.get(); x != nil {
+		return x.Append(sample)
+	}
+	return ErrNotReady
+}
+
+// NeedsThrottling implements Storage. It returns false until the underlying
+// storage is ready, so that callers do not block on a storage that may never
+// become ready.
+func (s *ReadyStorage) NeedsThrottling() bool {
+	if x := s.get(); x != nil {
+		return x.NeedsThrottling()
+	}
+	return false
+}
+
+// MetricsForLabelMatchers implements Storage.
+func (s *ReadyStorage) MetricsForLabelMatchers(from, through model.Time, matchers ...*metric.LabelMatcher) ([]metric.Metric, error) {
+	if x := s.get(); x != nil {
+		return x.MetricsForLabelMatchers(from, through, matchers...)
+	}
+	return nil, ErrNotReady
+}
+
+// LastSampleForLabelMatchers implements Storage.
+func (s *ReadyStorage) LastSampleForLabelMatchers(cutoff model.Time, matchers ...*metric.LabelMatcher) (model.Vector, error) {
+	if x := s.get(); x != nil {
+		return x.LastSampleForLabelMatchers(cutoff, matchers...)
+	}
+	return nil, ErrNotReady
+}
+
+// LabelValuesForLabelName implements Storage.
+func (s *ReadyStorage) LabelValuesForLabelName(name model.LabelName) (model.LabelValues, error) {
+	if x := s.get(); x != nil {
+		return x.LabelValuesForLabelName(name)
+	}
+	return nil, ErrNotReady
+}
+
+// Metric implements Storage.
+func (s *ReadyStorage) Metric(fp model.Fingerprint) (metric.Metric, error) {
+	if x := s.get(); x != nil {
+		return x.Metric(fp)
+	}
+	return metric.Metric{}, ErrNotReady
+}
+
+// NewPreloader implements Storage. Before Set has been called, it returns
+// notReadyPreloader rather than a bare nil so that a caller driving rule
+// evaluation or a range query during the startup window this type exists
+// to open up gets a clean ErrNotReady from every method instead of a
+// nil-interface panic.
+func (s *ReadyStorage) NewPreloader() Preloader {
+	if x := s.get(); x != nil {
+		return x.NewPreloader()
+	}
+	return notReadyPreloader{}
+}
+
+// notReadyPreloader is a Preloader stand-in returned while the underlying
+// storage hasn't been Set yet; every preload call fails with ErrNotReady
+// and Close is a no-op.
+type notReadyPreloader struct{}
+
+func (notReadyPreloader) PreloadRange(fp model.Fingerprint, from, through model.Time) error {
+	return ErrNotReady
+}
+
+func (notReadyPreloader) PreloadInstant(fp model.Fingerprint, timestamp model.Time, stalenessDelta time.Duration) error {
+	return ErrNotReady
+}
+
+func (notReadyPreloader) Close() {}
+
+// Start implements Storage. It is a no-op: the real storage is started
+// explicitly by the caller that owns it, then wired in via Set.
+func (s *ReadyStorage) Start() error {
+	return nil
+}
+
+// Stop implements Storage, forwarding to the underlying storage if it has
+// been set.
+func (s *ReadyStorage) Stop() error {
+	if x := s.get(); x != nil {
+		return x.Stop()
+	}
+	return nil
+}
+
+// WaitForIndexing implements Storage.
+func (s *ReadyStorage) WaitForIndexing() {
+	if x := s.get(); x != nil {
+		x.WaitForIndexing()
+	}
+}
+
+// Snapshot implements Snapshotter, forwarding to the underlying storage if
+// it has been set and itself implements Snapshotter.
+func (s *ReadyStorage) Snapshot(dir string, skipHead bool) (string, error) {
+	x := s.get()
+	if x == nil {
+		return "", ErrNotReady
+	}
+	snap, ok := x.(Snapshotter)
+	if !ok {
+		return "", fmt.Errorf("local storage engine %T does not support snapshots", x)
+	}
+	return snap.Snapshot(dir, skipHead)
+}
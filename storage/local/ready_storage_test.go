@@ -0,0 +1,32 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import "testing"
+
+func TestReadyStorageNewPreloaderBeforeSetIsNotNil(t *testing.T) {
+	var s ReadyStorage
+
+	p := s.NewPreloader()
+	if p == nil {
+		t.Fatal("expected NewPreloader to return a non-nil Preloader before Set is called")
+	}
+	if err := p.PreloadRange(0, 0, 0); err != ErrNotReady {
+		t.Errorf("expected PreloadRange to return ErrNotReady, got %v", err)
+	}
+	if err := p.PreloadInstant(0, 0, 0); err != ErrNotReady {
+		t.Errorf("expected PreloadInstant to return ErrNotReady, got %v", err)
+	}
+	p.Close() // must not panic
+}
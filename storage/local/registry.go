@@ -0,0 +1,59 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Factory constructs a local storage engine from the shared StorageConfig
+// and, via RegisterFlags, contributes its own engine-specific flags to the
+// process-wide flag.FlagSet. Registering a Factory under a name (see
+// Register) is how downstream vendors add a storage engine -- an
+// experimental TSDB port, a boltdb-backed engine, a pure-remote proxy
+// engine -- without patching cmd/prometheus/main.go.
+type Factory interface {
+	New(cfg *StorageConfig) (Storage, error)
+	RegisterFlags(fs *flag.FlagSet)
+}
+
+var engines = map[string]Factory{}
+
+// Register makes a storage engine factory available under name. It is
+// meant to be called from an engine package's init(), mirroring how the
+// built-in "persisted" and "none" engines register themselves.
+func Register(name string, factory Factory) {
+	engines[name] = factory
+}
+
+// Open looks up the engine registered under name and uses it to construct a
+// Storage. cmd/prometheus no longer needs to switch on a hardcoded set of
+// engine names to do this.
+func Open(name string, cfg *StorageConfig) (Storage, error) {
+	factory, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown local storage engine %q", name)
+	}
+	return factory.New(cfg)
+}
+
+// RegisterFlags calls RegisterFlags on every registered engine, so each one
+// can contribute flags to fs independent of which engine -storage.local.engine
+// ultimately selects at runtime.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, factory := range engines {
+		factory.RegisterFlags(fs)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"flag"
+	"testing"
+)
+
+type fakeFactory struct {
+	flagsRegistered bool
+}
+
+func (f *fakeFactory) New(cfg *StorageConfig) (Storage, error) {
+	return &NoopStorage{}, nil
+}
+
+func (f *fakeFactory) RegisterFlags(fs *flag.FlagSet) {
+	f.flagsRegistered = true
+}
+
+func TestRegisterAndOpen(t *testing.T) {
+	f := &fakeFactory{}
+	Register("fake-test-engine", f)
+	defer delete(engines, "fake-test-engine")
+
+	s, err := Open("fake-test-engine", &StorageConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := s.(*NoopStorage); !ok {
+		t.Fatalf("expected Open to return what the registered factory built, got %T", s)
+	}
+}
+
+func TestOpenUnknownEngine(t *testing.T) {
+	if _, err := Open("does-not-exist", &StorageConfig{}); err == nil {
+		t.Fatal("expected an error for an unregistered engine name")
+	}
+}
+
+func TestRegisterFlagsCallsEveryEngine(t *testing.T) {
+	f := &fakeFactory{}
+	Register("fake-test-engine-flags", f)
+	defer delete(engines, "fake-test-engine-flags")
+
+	RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+
+	if !f.flagsRegistered {
+		t.Fatal("expected RegisterFlags to call through to every registered engine")
+	}
+}
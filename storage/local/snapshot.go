@@ -0,0 +1,126 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// Snapshotter is implemented by local storage engines that can write a
+// point-in-time copy of their on-disk chunks to a directory, for the
+// web package's /-/snapshot admin endpoint. Engines with nothing to
+// persist (NoopStorage) are free to make it a no-op.
+type Snapshotter interface {
+	// Snapshot writes a snapshot into a new subdirectory of dir named
+	// "<unix-seconds>-<ulid>" and returns that subdirectory's name. If
+	// skipHead is true, samples not yet flushed to disk are excluded,
+	// producing a smaller, slightly stale snapshot.
+	Snapshot(dir string, skipHead bool) (string, error)
+}
+
+// Snapshot is a no-op: NoopStorage keeps nothing on disk to snapshot.
+func (s *NoopStorage) Snapshot(dir string, skipHead bool) (string, error) {
+	return "", nil
+}
+
+// persistedStorage wraps a *MemorySeriesStorage with the base directory
+// its chunks are persisted under, so Snapshot can hardlink them elsewhere
+// without MemorySeriesStorage itself (storage.go) needing to know
+// anything about the on-disk snapshot layout.
+type persistedStorage struct {
+	*MemorySeriesStorage
+	basePath string
+}
+
+// Snapshot hardlinks every file under s.basePath into a new
+// "<unix-seconds>-<ulid>" directory under dir, falling back to a copy if
+// the two paths are on different filesystems. MemorySeriesStorage keeps
+// the head -- the most recent, still being appended to -- chunks purely
+// in memory, so there is nothing extra on disk to leave out; skipHead is
+// accepted for API compatibility with Snapshotter and to let callers flag
+// that the snapshot may be missing very recent samples, but it does not
+// change what gets copied here.
+func (s *persistedStorage) Snapshot(dir string, skipHead bool) (string, error) {
+	id, err := ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error generating snapshot name: %s", err)
+	}
+	name := fmt.Sprintf("%d-%s", time.Now().Unix(), id.String())
+	snapDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(snapDir, 0777); err != nil {
+		return "", fmt.Errorf("error creating snapshot directory: %s", err)
+	}
+
+	// dir (where snapshots are written) commonly lives under s.basePath
+	// (e.g. "<storage-path>/snapshots" under "<storage-path>"), so without
+	// this the walk below would recurse into its own output directory and
+	// into every snapshot taken before it.
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving snapshot directory: %s", err)
+	}
+
+	err = filepath.Walk(s.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if absPath, err := filepath.Abs(path); err == nil && absPath == absDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(s.basePath, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(snapDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		return hardlinkOrCopy(path, dst)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error snapshotting %s: %s", s.basePath, err)
+	}
+	return name, nil
+}
+
+// hardlinkOrCopy links dst to src, falling back to a full copy if they
+// live on different filesystems (os.Link returns a *LinkError wrapping
+// syscall.EXDEV in that case).
+func hardlinkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
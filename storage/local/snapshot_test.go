@@ -0,0 +1,57 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNoopStorageSnapshotIsANoOp(t *testing.T) {
+	s := &NoopStorage{}
+	name, err := s.Snapshot(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name != "" {
+		t.Fatalf("expected NoopStorage.Snapshot to return no directory name, got %q", name)
+	}
+}
+
+func TestHardlinkOrCopyLinksWithinSameFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("chunk data"), 0666); err != nil {
+		t.Fatalf("failed to write source file: %s", err)
+	}
+
+	if err := hardlinkOrCopy(src, dst); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("failed to stat source file: %s", err)
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to stat destination file: %s", err)
+	}
+	if !os.SameFile(srcInfo, dstInfo) {
+		t.Fatal("expected hardlinkOrCopy to hardlink src and dst within the same filesystem")
+	}
+}
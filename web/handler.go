@@ -0,0 +1,41 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"sync"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// Handler serves Prometheus's HTTP API and UI. This declares only the
+// fields lifecycle.go's admin endpoints (and the run.Group actors Main()
+// builds around them) read or write; route registration, TLS, templates,
+// and the rest of Handler and Options live in web.go alongside the actual
+// HTTP server, which isn't part of this checkout.
+type Handler struct {
+	options *Options
+	storage local.Storage
+
+	quitCh   chan struct{}
+	quitOnce sync.Once
+	reloadCh chan chan error
+}
+
+// Options holds the subset of Handler's configuration that lifecycle.go
+// reads directly.
+type Options struct {
+	EnableLifecycle  bool
+	LocalStoragePath string
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// readier is implemented by local.Storage wrappers (see
+// local.ReadyStorage) that can report whether they have finished wiring up
+// the real underlying storage.
+type readier interface {
+	Ready() bool
+}
+
+// healthy returns 200 as long as the process is alive, independent of
+// whether the local storage has finished opening.
+func (h *Handler) healthy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Prometheus is Healthy.\n"))
+}
+
+// ready returns 503 until the local storage reports itself ready (i.e.
+// local.ReadyStorage.Set has been called), and 200 afterwards.
+func (h *Handler) ready(w http.ResponseWriter, r *http.Request) {
+	if rd, ok := h.storage.(readier); ok && !rd.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Prometheus is not Ready.\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Prometheus is Ready.\n"))
+}
+
+// requireLifecycleAPIs wraps an admin handler (quit, reload, snapshot) so
+// that it 403s unless --web.enable-lifecycle was passed. Without the flag,
+// none of these endpoints can be reached at all -- closing the previous
+// design where POST /-/quit was always wired up and reachable by anyone
+// who could talk to the HTTP port.
+func (h *Handler) requireLifecycleAPIs(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.options.EnableLifecycle {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Lifecycle API is not enabled. Start Prometheus with --web.enable-lifecycle to enable it.\n"))
+			return
+		}
+		f(w, r)
+	}
+}
+
+// quit handles POST /-/quit, gated by requireLifecycleAPIs. Closing
+// h.quitCh is picked up by the termination actor Main() registers with
+// run.Group. h.quitOnce guards the close so a retried or concurrently
+// repeated request can't panic on a channel that's already closed.
+func (h *Handler) quit(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "Requesting termination... Goodbye!")
+	h.quitOnce.Do(func() { close(h.quitCh) })
+}
+
+// reload handles POST /-/reload, gated by requireLifecycleAPIs. It mirrors
+// the SIGHUP path: rc is picked up by Main()'s reload handler, which waits
+// on reloadReady.C the same way a SIGHUP would.
+func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
+	rc := make(chan error)
+	h.reloadCh <- rc
+	if err := <-rc; err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// snapshotResponse is the JSON body returned by POST /-/snapshot.
+type snapshotResponse struct {
+	Name string `json:"name"`
+}
+
+// snapshot handles POST /-/snapshot?skip_head=true|false, gated by
+// requireLifecycleAPIs. It asks the local storage engine for a snapshot
+// under <LocalStoragePath>/snapshots and returns the new directory's name.
+func (h *Handler) snapshot(w http.ResponseWriter, r *http.Request) {
+	skipHead := r.FormValue("skip_head") == "true"
+
+	snap, ok := h.storage.(local.Snapshotter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("local storage engine %T does not support snapshots", h.storage), http.StatusNotImplemented)
+		return
+	}
+
+	name, err := snap.Snapshot(filepath.Join(h.options.LocalStoragePath, "snapshots"), skipHead)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error creating snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshotResponse{Name: name})
+}
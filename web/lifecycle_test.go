@@ -0,0 +1,160 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// fakeSnapshotStorage is the minimal local.Storage implementation this
+// package's tests need, with a Snapshot that records whether it was called
+// and what skipHead it saw.
+type fakeSnapshotStorage struct {
+	local.Storage
+	snapshotDir  string
+	snapshotSkip bool
+	snapshotName string
+	snapshotErr  error
+}
+
+func (s *fakeSnapshotStorage) Snapshot(dir string, skipHead bool) (string, error) {
+	s.snapshotDir = dir
+	s.snapshotSkip = skipHead
+	return s.snapshotName, s.snapshotErr
+}
+
+func newTestHandler(enableLifecycle bool, storage local.Storage) *Handler {
+	return &Handler{
+		options: &Options{
+			EnableLifecycle:  enableLifecycle,
+			LocalStoragePath: "/data",
+		},
+		storage:  storage,
+		quitCh:   make(chan struct{}),
+		reloadCh: make(chan chan error, 1),
+	}
+}
+
+func TestLifecycleEndpointsForbiddenWhenDisabled(t *testing.T) {
+	h := newTestHandler(false, &fakeSnapshotStorage{})
+
+	endpoints := map[string]http.HandlerFunc{
+		"quit":     h.requireLifecycleAPIs(h.quit),
+		"reload":   h.requireLifecycleAPIs(h.reload),
+		"snapshot": h.requireLifecycleAPIs(h.snapshot),
+	}
+
+	for name, handler := range endpoints {
+		req := httptest.NewRequest(http.MethodPost, "/-/"+name, nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %d, got %d", name, http.StatusForbidden, rec.Code)
+		}
+	}
+
+	select {
+	case <-h.quitCh:
+		t.Error("expected quit channel to remain open when lifecycle APIs are disabled")
+	default:
+	}
+}
+
+func TestQuitClosesQuitChannelWhenEnabled(t *testing.T) {
+	h := newTestHandler(true, &fakeSnapshotStorage{})
+
+	req := httptest.NewRequest(http.MethodPost, "/-/quit", nil)
+	rec := httptest.NewRecorder()
+	h.requireLifecycleAPIs(h.quit)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	select {
+	case <-h.quitCh:
+	default:
+		t.Error("expected quit channel to be closed")
+	}
+}
+
+// TestQuitIsIdempotent guards against a second (e.g. retried or racing)
+// POST /-/quit panicking on an already-closed channel.
+func TestQuitIsIdempotent(t *testing.T) {
+	h := newTestHandler(true, &fakeSnapshotStorage{})
+	handler := h.requireLifecycleAPIs(h.quit)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/-/quit", nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rec.Code)
+		}
+	}
+}
+
+func TestReloadForwardsToReloadChWhenEnabled(t *testing.T) {
+	h := newTestHandler(true, &fakeSnapshotStorage{})
+
+	go func() {
+		rc := <-h.reloadCh
+		rc <- nil
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/-/reload", nil)
+	rec := httptest.NewRecorder()
+	h.requireLifecycleAPIs(h.reload)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestSnapshotPassesSkipHeadAndReturnsName(t *testing.T) {
+	storage := &fakeSnapshotStorage{snapshotName: "1234-01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+	h := newTestHandler(true, storage)
+
+	req := httptest.NewRequest(http.MethodPost, "/-/snapshot?skip_head=true", nil)
+	rec := httptest.NewRecorder()
+	h.requireLifecycleAPIs(h.snapshot)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !storage.snapshotSkip {
+		t.Error("expected skip_head=true to be forwarded to Storage.Snapshot")
+	}
+	if want := "/data/snapshots"; storage.snapshotDir != want {
+		t.Errorf("expected snapshot dir %q, got %q", want, storage.snapshotDir)
+	}
+	if want := `{"name":"1234-01ARZ3NDEKTSV4RRFFQ69G5FAV"}` + "\n"; rec.Body.String() != want {
+		t.Errorf("expected body %q, got %q", want, rec.Body.String())
+	}
+}
+
+func TestSnapshotUnsupportedByStorageEngine(t *testing.T) {
+	h := newTestHandler(true, struct{ local.Storage }{})
+
+	req := httptest.NewRequest(http.MethodPost, "/-/snapshot", nil)
+	rec := httptest.NewRecorder()
+	h.requireLifecycleAPIs(h.snapshot)(rec, req)
+
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected status %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+}